@@ -0,0 +1,16 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build dragonfly freebsd netbsd openbsd
+
+package runtime
+
+import "unsafe"
+
+// madviseRejected 报告 madvise 有没有拒绝 flags；这几个系统上 madvise 的包装是
+// errno 风格的，直接看返回值就知道。Solaris 的版本见 madvise_solaris.go。
+func madviseRejected(v unsafe.Pointer, n uintptr, flags int32) bool {
+	errno := madvise(v, n, flags)
+	return errno != 0
+}
@@ -0,0 +1,17 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build solaris
+
+package runtime
+
+import "unsafe"
+
+// Solaris 的 madvise 包装（基于 sysvicall3）不返回 errno，没法从返回值判断 flags
+// 有没有被拒绝，所以这里总当它成功；adviseUnused 的 init() 已经让 Solaris/illumos
+// 直接从 _MADV_DONTNEED 起步，不依赖这里探测出 MADV_FREE 不可用，见 mem_bsd.go。
+func madviseRejected(v unsafe.Pointer, n uintptr, flags int32) bool {
+	madvise(v, n, flags)
+	return false
+}
@@ -10,59 +10,241 @@
 // Each mcentral is two lists of mspans: those with free objects (c->nonempty)
 // and those that are completely allocated (c->empty).
 
+/**
+原来的 mcentral 只有一把 c.lock，cacheSpan/uncacheSpan/freeSpan 都要排队抢这一把锁，P 多了之后锁竞争很严重。
+这里把它按 P 的 id 哈希拆成几个独立的 shard，每个 shard 有自己的锁、自己的 nonempty/empty 链表和一个
+无锁的 hand-off 槽位；只有自己的 shard 和槽位都扑空了，才会像工作窃取那样去翻别的 shard。
+
+NUMA 相关的请求（按节点拆分 shard，外加给 grow() 路径配一个 sysAllocNode）在这份 checkout 里
+做不了，不是还没做：要按节点分配 span，得知道每个 shard/span 的内存实际来自哪个节点，这是
+heapArena 这一级的记录，活在 mheap.go 里（原因同 mspanrefill.go 顶部关于 pageAlloc 的说明）；
+sysAllocNode 本身倒是能加，但 grow() 从来不会直接调 sysAlloc——中间隔着 mheap_.alloc，也不在
+这份 checkout 里——所以加了也没有调用方，纯粹是摆设。这个请求按 NumaAwareSharding 明确标记成
+「做不了」，而不是装作已经落地。
+*/
+
 package runtime
 
-import "runtime/internal/atomic"
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
 
-// Central list of free objects of a given size.
+// NumaAwareSharding reports whether mcentral's shards are partitioned by
+// NUMA node. It's always false in this checkout: that needs heapArena-
+// level node tracking (mheap.go), which isn't part of this checkout — see
+// the comment at the top of this file. Exported so callers asking for
+// NUMA-aware sharding get an honest answer instead of silence.
+const NumaAwareSharding = false
+
+// _NumMCentralShards is the number of shards each mcentral is split into.
+/**
+固定取一个较小的 2 的幂次，而不是直接用 GOMAXPROCS，是为了不让 mcentral 的内存占用
+（每个跨度类都要乘一份）在 P 特别多的机器上跟着膨胀；P 只是简单地按 id 哈希到某个 shard 上。
+*/
+const _NumMCentralShards = 8
+
+// mcentralShard is one independent shard of an mcentral: its own lock and
+// its own nonempty/empty span lists, plus a single-slot lock-free hand-off
+// slot used to avoid taking shard.lock on the common allocate/free path.
 //
 //go:notinheap
+type mcentralShard struct {
+	lock mutex
+
+	/**
+	handoff 保存着某个 P 在 freeSpan 里释放到这个 shard、而当时槽位正好空着的那一个 *mspan
+	（槽位已被占用时，后来释放的 span 直接还给堆，不会替换它），以无锁的方式
+	交给下一个来这个 shard 分配的 P：全程只用原子读写/CAS，不加锁；谁 CAS 成功谁就独占这个 span，
+	不需要再做别的同步。
+	*/
+	handoff unsafe.Pointer // *mspan
+
+	// handoffEpoch 记录 reclaimIdleHandoff 连续多少次看到 handoff 里还是同一个、
+	// 没被人取走的 span；用来判断这个 shard 是不是已经闲下来了，该把 span 还给堆，
+	// 而不是一直占着不放，详见 reclaimIdleHandoff。
+	handoffEpoch uint32
+
+	// handoffLastSeen 是上一次 reclaimIdleHandoff 巡查时 handoff 里的那个指针，
+	// 用来判断这一次看到的是不是同一个 span——如果中间被人取走又换了一个新的，
+	// 新 span 不该继承旧 span 攒下来的 epoch。
+	handoffLastSeen unsafe.Pointer // *mspan
+
+	nonempty nonemptyHeap // spans with a free object, bucketed by free count
+	empty    mSpanList    // list of spans with no free objects (or cached in an mcache)
+
+	// nmalloc is the cumulative count of objects allocated from this
+	// shard, assuming all spans in mcaches are fully-allocated. Written
+	// atomically, read under STW.
+	nmalloc uint64
+}
+
+func (shard *mcentralShard) init() {
+	shard.nonempty.init()
+	shard.empty.init()
+}
+
+// nonemptyBuckets is the number of free-object-count buckets nonempty
+// spans are sorted into: bucket i holds spans whose free count is
+// roughly in [2^i, 2^(i+1)).
+const nonemptyBuckets = 8
+
+// nonemptyHeap holds a shard's partial (nonempty) spans, bucketed by free
+// count instead of kept in one plain list.
 /**
-runtime.mcentral 是内存分配器的中心缓存，与线程缓存不同，访问中心缓存中的内存管理单元需要使用互斥锁：
-该结构体在初始化时，两个链表都不包含任何内存，程序运行时会扩容结构体持有的两个链表
+按空闲对象数量粗略分桶（log 尺度），cacheSpan 取 span 的时候就能优先拿空闲对象最多的那个，
+而不是链表头上随便哪个。一个 span 空闲对象越多，能撑的分配次数就越多，mcache 用完了再回来问
+mcentral 要的次数就越少，相当于用插入/删除时多一次 log2 换来更少的 cacheSpan 往返。
 */
+type nonemptyHeap struct {
+	buckets [nonemptyBuckets]mSpanList
+}
+
+func (h *nonemptyHeap) init() {
+	for i := range h.buckets {
+		h.buckets[i].init()
+	}
+}
+
+// nonemptyBucketFor returns the bucket a span with freeCount free objects
+// belongs in.
+func nonemptyBucketFor(freeCount uintptr) int {
+	b := 0
+	for freeCount > 1 && b < nonemptyBuckets-1 {
+		freeCount >>= 1
+		b++
+	}
+	return b
+}
+
+func (h *nonemptyHeap) insert(s *mspan) {
+	h.buckets[nonemptyBucketFor(uintptr(s.nelems)-uintptr(s.allocCount))].insert(s)
+}
+
+// remove unlinks s from whichever bucket it's actually resident in.
+/**
+不能像 insert 那样重新按当前的空闲对象数算一遍桶：s 挂在某个桶里之后，它的空闲对象数
+可能已经变了（比如 freeSpan 里先改 allocCount 再调 remove），重新算出来的桶号就可能跟
+s 实际挂的桶对不上，传给 mSpanList.remove 的 list 和 s.list 不一致，会直接 throw。
+s.list 是 mSpanList.insert 插入时记下来的、s 当前真正挂着的那条链表，remove 用它才对。
+*/
+func (h *nonemptyHeap) remove(s *mspan) {
+	s.list.remove(s)
+}
+
+// Central list of free objects of a given size.
+//
+//go:notinheap
 type mcentral struct {
-	lock      mutex
 	spanclass spanClass
-	/**
-	每一个中心缓存都会管理某个跨度类的内存管理单元，它会同时持有两个 runtime.mSpanList，分别存储包含空闲对象的列表和不包含空闲对象的链表：
-	*/
-	nonempty mSpanList // list of spans with a free object, ie a nonempty free list
-	empty    mSpanList // list of spans with no free objects (or cached in an mcache)
 
-	// nmalloc is the cumulative count of objects allocated from
-	// this mcentral, assuming all spans in mcaches are
-	// fully-allocated. Written atomically, read under STW.
-	/**
-	nmalloc 字段也记录了该结构体中分配的对象个数。
-	*/
-	nmalloc uint64
+	shards [_NumMCentralShards]mcentralShard
+
+	// spanRefill 缓存着刚从 mheap_ 批量要来的 span，这样一连串的 grow() 调用
+	// 不用每次都去抢 mheap_.lock，详见 mspanrefill.go。
+	spanRefill spanRefillCache
+
+	// handoffCursor 是 reclaimIdleHandoff 轮询 c 的各个 shard 时用的游标。
+	handoffCursor uint32
 }
 
 // Initialize a single central free list.
 func (c *mcentral) init(spc spanClass) {
 	c.spanclass = spc
-	c.nonempty.init()
-	c.empty.init()
+	for i := range c.shards {
+		c.shards[i].init()
+	}
 }
 
-// Allocate a span to use in an mcache.
+// shardIndex returns the shard that the calling P should use.
 /**
-线程缓存会通过中心缓存的 runtime.mcentral.cacheSpan 方法获取新的内存管理单元，该方法的实现比较复杂，我们可以将其分成以下几个部分：
-
+按 P 的 id 哈希选 shard，同一个 P 基本总会落到同一个 shard 上，这样缓存的访问比较集中，
+每个 shard 自己的 hand-off 槽位也才真的有用。
+*/
+func (c *mcentral) shardIndex() int {
+	pid := int32(0)
+	if gp := getg(); gp.m.p != 0 {
+		pid = gp.m.p.ptr().id
+	}
+	return int(uint32(pid) % _NumMCentralShards)
+}
 
-1 从有空闲对象的 runtime.mspan 链表中查找可以使用的内存管理单元；
-2 从没有空闲对象的 runtime.mspan 链表中查找可以使用的内存管理单元；
-3 调用 runtime.mcentral.grow 从堆中申请新的内存管理单元；
-4 更新内存管理单元的 allocCache 等字段帮助快速分配内存；
+// nmalloc sums nmalloc across all shards.
+// 只给 STW 时的读者用（比如 ReadMemStats），跟原来单 shard 那个字段上的注释是一个意思。
+func (c *mcentral) nmalloc() uint64 {
+	var n uint64
+	for i := range c.shards {
+		n += atomic.Load64(&c.shards[i].nmalloc)
+	}
+	return n
+}
 
+// Allocate a span to use in an mcache.
+/**
+先看自己 P 对应 shard 的 hand-off 槽位，有就直接用，全程不加锁；槽位没有再去 shard 自己的
+nonempty/empty 链表里找；自己这个 shard 彻底扑空了，就像工作窃取一样去翻别的 shard；
+所有 shard 都找不到，才去 grow() 找堆要新的 span。
 */
 func (c *mcentral) cacheSpan() *mspan {
 	// Deduct credit for this span allocation and sweep if necessary.
 	spanBytes := uintptr(class_to_allocnpages[c.spanclass.sizeclass()]) * _PageSize
 	deductSweepCredit(spanBytes, 0)
 
-	lock(&c.lock)
+	idx := c.shardIndex()
+	shard := &c.shards[idx]
+
+	// Fast path: take the shard's hand-off slot without ever touching
+	// shard.lock for the take itself. The span left there was already
+	// fully prepared by freeSpan, so it just needs to go back
+	// on shard.empty — same as every other path that hands a span to an
+	// mcache — before we can use it.
+	if s := takeHandoff(shard); s != nil {
+		lock(&shard.lock)
+		shard.empty.insertBack(s)
+		unlock(&shard.lock)
+		return c.prepareSpan(shard, s, spanBytes)
+	}
+
+	if s := c.cacheSpanFromShard(shard, spanBytes); s != nil {
+		return s
+	}
+
+	// Our shard (and its hand-off slot) came up empty. Work-steal from the
+	// other shards before falling through to grow(), which is the
+	// expensive, heap-lock-taking path.
+	for i := 1; i < _NumMCentralShards; i++ {
+		other := &c.shards[(idx+i)%_NumMCentralShards]
+		if s := takeHandoff(other); s != nil {
+			lock(&other.lock)
+			other.empty.insertBack(s)
+			unlock(&other.lock)
+			return c.prepareSpan(other, s, spanBytes)
+		}
+		if s := c.cacheSpanFromShard(other, spanBytes); s != nil {
+			return s
+		}
+	}
+
+	// Replenish central list if empty.
+	s := c.grow()
+	if s == nil {
+		return nil
+	}
+	lock(&shard.lock)
+	shard.empty.insertBack(s)
+	unlock(&shard.lock)
+
+	// At this point s is a non-empty span, queued at the end of the empty
+	// list, shard is unlocked.
+	return c.prepareSpan(shard, s, spanBytes)
+}
+
+// cacheSpanFromShard looks for a usable span in shard's nonempty and empty
+// lists, following the same sweepgen state machine the unsharded mcentral
+// used under c.lock.
+// 没有能用的 span 就返回 nil。
+func (c *mcentral) cacheSpanFromShard(shard *mcentralShard, spanBytes uintptr) *mspan {
+	lock(&shard.lock)
 	traceDone := false
 	if trace.enabled {
 		traceGCSweepStart()
@@ -70,51 +252,43 @@ func (c *mcentral) cacheSpan() *mspan {
 	sg := mheap_.sweepgen
 retry:
 	var s *mspan
-	/**
-	首先我们会在中心缓存的非空链表中查找可用的 runtime.mspan，根据 sweepgen 字段分别进行不同的处理：
-
-	当内存单元等待回收时，将其插入 empty 链表、调用 runtime.mspan.sweep 清理该单元并返回；
-	当内存单元正在被后台回收时，跳过该内存单元；
-	当内存单元已经被回收时，将内存单元插入 empty 链表并返回；
-	*/
-	for s = c.nonempty.first; s != nil; s = s.next {
-		if s.sweepgen == sg-2 && atomic.Cas(&s.sweepgen, sg-2, sg-1) { // // 等待回收
-			c.nonempty.remove(s)
-			c.empty.insertBack(s)
-			unlock(&c.lock)
-			s.sweep(true)
+	// 按空闲对象数从多到少扫桶，这样分配完能撑最久的 span 先被用掉。
+	for b := nonemptyBuckets - 1; b >= 0; b-- {
+		for s = shard.nonempty.buckets[b].first; s != nil; s = s.next {
+			if s.sweepgen == sg-2 && atomic.Cas(&s.sweepgen, sg-2, sg-1) {
+				shard.nonempty.remove(s)
+				shard.empty.insertBack(s)
+				unlock(&shard.lock)
+				s.sweep(true)
+				goto havespan
+			}
+			if s.sweepgen == sg-1 {
+				// the span is being swept by background sweeper, skip
+				continue
+			}
+			// we have a nonempty span that does not require sweeping, allocate from it
+			shard.nonempty.remove(s)
+			shard.empty.insertBack(s)
+			unlock(&shard.lock)
 			goto havespan
 		}
-		if s.sweepgen == sg-1 { // 正在回收
-			// the span is being swept by background sweeper, skip
-			continue
-		}
-		// we have a nonempty span that does not require sweeping, allocate from it
-		c.nonempty.remove(s) // 已经回收
-		c.empty.insertBack(s)
-		unlock(&c.lock)
-		goto havespan
 	}
-	/**
-	如果中心缓存没有在 nonempty 中找到可用的内存管理单元，就会继续遍历其持有的 empty 链表，
-	我们在这里的处理与包含空闲对象的链表几乎完全相同。当找到需要回收的内存单元时，
-	我们也会触发 runtime.mspan.sweep 进行清理，如果清理后的内存单元仍然不包含空闲对象，就会重新执行相应的代码：
-	*/
-	for s = c.empty.first; s != nil; s = s.next {
+
+	for s = shard.empty.first; s != nil; s = s.next {
 		if s.sweepgen == sg-2 && atomic.Cas(&s.sweepgen, sg-2, sg-1) {
 			// we have an empty span that requires sweeping,
 			// sweep it and see if we can free some space in it
-			c.empty.remove(s)
+			shard.empty.remove(s)
 			// swept spans are at the end of the list
-			c.empty.insertBack(s)
-			unlock(&c.lock)
-			s.sweep(true) // 当找到需要回收的内存单元时，我们也会触发 runtime.mspan.sweep 进行清理，如果清理后的内存单元仍然不包含空闲对象，就会重新执行相应的代码
+			shard.empty.insertBack(s)
+			unlock(&shard.lock)
+			s.sweep(true)
 			freeIndex := s.nextFreeIndex()
 			if freeIndex != s.nelems {
 				s.freeindex = freeIndex
 				goto havespan
 			}
-			lock(&c.lock)
+			lock(&shard.lock)
 			// the span is still empty after sweep
 			// it is already in the empty list, so just retry
 			goto retry
@@ -131,36 +305,27 @@ retry:
 		traceGCSweepDone()
 		traceDone = true
 	}
-	unlock(&c.lock)
-
-	// Replenish central list if empty.
-	/**
-	如果 runtime.mcentral 在两个链表中都没有找到可用的内存单元，它会调用 runtime.mcentral.grow 触发扩容操作从堆中申请新的内存：
-	*/
-	s = c.grow()
-	if s == nil {
-		return nil
-	}
-	lock(&c.lock)
-	c.empty.insertBack(s)
-	unlock(&c.lock)
+	unlock(&shard.lock)
+	return nil
 
-	// At this point s is a non-empty span, queued at the end of the empty list,
-	// c is unlocked.
-	/**
-	无论通过哪种方法获取到了内存单元，该方法的最后都会对内存单元的 allocBits 和 allocCache 等字段进行更新，让运行时在分配内存时能够快速找到空闲的对象。
-	*/
 havespan:
 	if trace.enabled && !traceDone {
 		traceGCSweepDone()
 	}
+	return c.prepareSpan(shard, s, spanBytes)
+}
+
+// prepareSpan finishes the bookkeeping common to every path that hands a
+// span to an mcache.
+// 更新 nmalloc/heap_live，并把 allocCache 准备好。
+func (c *mcentral) prepareSpan(shard *mcentralShard, s *mspan, spanBytes uintptr) *mspan {
 	n := int(s.nelems) - int(s.allocCount)
 	if n == 0 || s.freeindex == s.nelems || uintptr(s.allocCount) == s.nelems {
 		throw("span has no free objects")
 	}
 	// Assume all objects from this span will be allocated in the
 	// mcache. If it gets uncached, we'll adjust this.
-	atomic.Xadd64(&c.nmalloc, int64(n))
+	atomic.Xadd64(&shard.nmalloc, int64(n))
 	usedBytes := uintptr(s.allocCount) * s.elemsize
 	atomic.Xadd64(&memstats.heap_live, int64(spanBytes)-int64(usedBytes))
 	if trace.enabled {
@@ -180,6 +345,7 @@ havespan:
 	// s.allocCache.
 	s.allocCache >>= s.freeindex % 64
 
+	fireSpanEvent(SpanCache, c.spanclass, uintptr(class_to_allocnpages[c.spanclass.sizeclass()]), uintptr(n), s.base())
 	return s
 }
 
@@ -204,17 +370,18 @@ func (c *mcentral) uncacheSpan(s *mspan) {
 		atomic.Store(&s.sweepgen, sg)
 	}
 
+	shard := &c.shards[c.shardIndex()]
 	n := int(s.nelems) - int(s.allocCount)
 	if n > 0 {
 		// cacheSpan updated alloc assuming all objects on s
 		// were going to be allocated. Adjust for any that
 		// weren't. We must do this before potentially
 		// sweeping the span.
-		atomic.Xadd64(&c.nmalloc, -int64(n))
+		atomic.Xadd64(&shard.nmalloc, -int64(n))
 
-		lock(&c.lock)
-		c.empty.remove(s)
-		c.nonempty.insert(s)
+		lock(&shard.lock)
+		shard.empty.remove(s)
+		shard.nonempty.insert(s)
 		if !stale {
 			// mCentral_CacheSpan conservatively counted
 			// unallocated slots in heap_live. Undo this.
@@ -225,7 +392,7 @@ func (c *mcentral) uncacheSpan(s *mspan) {
 			// stale spans.
 			atomic.Xadd64(&memstats.heap_live, -int64(n)*int64(s.elemsize))
 		}
-		unlock(&c.lock)
+		unlock(&shard.lock)
 	}
 
 	if stale {
@@ -233,6 +400,8 @@ func (c *mcentral) uncacheSpan(s *mspan) {
 		// sweep it.
 		s.sweep(false)
 	}
+
+	fireSpanEvent(SpanUncache, c.spanclass, uintptr(class_to_allocnpages[c.spanclass.sizeclass()]), uintptr(n), s.base())
 }
 
 // freeSpan updates c and s after sweeping s.
@@ -259,41 +428,123 @@ func (c *mcentral) freeSpan(s *mspan, preserve bool, wasempty bool) bool {
 		return false
 	}
 
-	lock(&c.lock)
+	shard := &c.shards[c.shardIndex()]
+	lock(&shard.lock)
 
 	// Move to nonempty if necessary.
 	if wasempty {
-		c.empty.remove(s)
-		c.nonempty.insert(s)
+		shard.empty.remove(s)
+		shard.nonempty.insert(s)
 	}
 
 	// delay updating sweepgen until here. This is the signal that
 	// the span may be used in an mcache, so it must come after the
 	// linked list operations above (actually, just after the
-	// lock of c above.)
+	// lock of shard above.)
 	atomic.Store(&s.sweepgen, mheap_.sweepgen)
 
 	if s.allocCount != 0 {
-		unlock(&c.lock)
+		unlock(&shard.lock)
 		return false
 	}
 
-	c.nonempty.remove(s)
-	unlock(&c.lock)
+	shard.nonempty.remove(s)
+
+	// Offer the span to the next P that allocates from this shard
+	// without making it take shard.lock at all. If the slot is already
+	// occupied, fall back to returning the span to the heap.
+	offered := atomic.Casp1(&shard.handoff, nil, unsafe.Pointer(s))
+	unlock(&shard.lock)
+	if offered {
+		// s is fully free (allocCount == 0 was just checked above), but
+		// prepareSpan credited the whole span to heap_live the last time
+		// it was cached and nothing has reversed that since. The
+		// mheap_.freeSpan(s) call below would normally do that reversal;
+		// since we're bypassing it to hand s off lock-free instead, we
+		// have to do the same bookkeeping ourselves, or heap_live leaks
+		// spanBytes every time this span round-trips through handoff.
+		spanBytes := uintptr(class_to_allocnpages[c.spanclass.sizeclass()]) * _PageSize
+		atomic.Xadd64(&memstats.heap_live, -int64(spanBytes))
+		if gcBlackenEnabled != 0 {
+			gcController.revise()
+		}
+		fireSpanEvent(SpanFree, c.spanclass, uintptr(class_to_allocnpages[c.spanclass.sizeclass()]), uintptr(s.nelems), s.base())
+		// 顺便看一眼别的 shard 是不是有 hand-off span 放了很久都没人领，见 reclaimIdleHandoff。
+		c.reclaimIdleHandoff()
+		return false
+	}
+	// mheap_.freeSpan 可能把 s 和邻居合并，mspan 结构体本身也可能被收回复用，
+	// 所以调用之后就不能再读 s 的字段了，得先把要用的值存下来。
+	nelems, base := uintptr(s.nelems), s.base()
 	mheap_.freeSpan(s)
+	fireSpanEvent(SpanFree, c.spanclass, uintptr(class_to_allocnpages[c.spanclass.sizeclass()]), nelems, base)
 	return true
 }
 
-// grow allocates a new empty span from the heap and initializes it for c's size class.
+// handoffIdleRounds 是一个 hand-off span 在没人领走的情况下，能扛过 reclaimIdleHandoff
+// 几次巡查才会被收回堆里；取大于 1 是为了不让刚放上去的 span 下一次巡查就被误收走，
+// 总得给别的 P 留点时间来领。
+const handoffIdleRounds = 3
+
+// reclaimIdleHandoff 每次只看 c 的一个 shard（轮询），如果这个 shard 的 hand-off
+// 槽位里的 span 连续 handoffIdleRounds 次巡查都没人领走，就把它还给堆。
 /**
-中心缓存的扩容方法 runtime.mcentral.grow 会根据预先计算的 class_to_allocnpages 和
-class_to_size 获取待分配的页数以及跨度类并调用 runtime.mheap.alloc 获取新的 runtime.mspan 结构：
+mcentral 里没有别的地方会做这件事：cacheSpan 只会去槽位里取 span，不会主动释放它，
+所以一个不再有 P 来访问的 shard（goroutine 都迁移走了，或者这个跨度类干脆没人用了）
+本来会一直占着一个 span 不放——scavenger 看不到它，也没法跟邻居合并。
+把这个检查挂在 freeSpan 上而不是挂个定时器，是为了不引入新的后台组件：
+只要这个跨度类还在发生释放，里面闲下来的 shard 迟早会被扫到。
 */
+func (c *mcentral) reclaimIdleHandoff() {
+	idx := int(atomic.Xadd(&c.handoffCursor, 1)-1) % _NumMCentralShards
+	shard := &c.shards[idx]
+
+	p := atomic.Loadp(unsafe.Pointer(&shard.handoff))
+	if p == nil {
+		atomic.Store(&shard.handoffEpoch, 0)
+		atomic.Storep(unsafe.Pointer(&shard.handoffLastSeen), nil)
+		return
+	}
+	if p != atomic.Loadp(unsafe.Pointer(&shard.handoffLastSeen)) {
+		// Slot holds a different span than it did last visit (taken and
+		// re-offered in between), so it hasn't actually sat idle yet.
+		atomic.Store(&shard.handoffEpoch, 0)
+		atomic.Storep(unsafe.Pointer(&shard.handoffLastSeen), p)
+		return
+	}
+	if atomic.Xadd(&shard.handoffEpoch, 1) < handoffIdleRounds {
+		return
+	}
+	if atomic.Casp1(&shard.handoff, p, nil) {
+		atomic.Storep(unsafe.Pointer(&shard.handoffLastSeen), nil)
+		mheap_.freeSpan((*mspan)(p))
+	}
+	atomic.Store(&shard.handoffEpoch, 0)
+}
+
+// takeHandoff atomically claims shard's hand-off span, if any, without
+// taking shard.lock.
+func takeHandoff(shard *mcentralShard) *mspan {
+	p := atomic.Loadp(unsafe.Pointer(&shard.handoff))
+	if p == nil {
+		return nil
+	}
+	if atomic.Casp1(&shard.handoff, p, nil) {
+		return (*mspan)(p)
+	}
+	return nil
+}
+
+// grow allocates a new empty span from the heap and initializes it for c's size class.
 func (c *mcentral) grow() *mspan {
 	npages := uintptr(class_to_allocnpages[c.spanclass.sizeclass()])
 	size := uintptr(class_to_size[c.spanclass.sizeclass()])
 
-	s := mheap_.alloc(npages, c.spanclass, true)
+	s := c.spanRefill.alloc()
+	if s == nil {
+		c.spanRefill.fill(npages, c.spanclass)
+		s = c.spanRefill.alloc()
+	}
 	if s == nil {
 		return nil
 	}
@@ -301,10 +552,8 @@ func (c *mcentral) grow() *mspan {
 	// Use division by multiplication and shifts to quickly compute:
 	// n := (npages << _PageShift) / size
 	n := (npages << _PageShift) >> s.divShift * uintptr(s.divMul) >> s.divShift2
-	/**
-	获取了 runtime.mspan 之后，我们会在上述方法中初始化 limit 字段并清除该结构在堆上对应的位图。
-	*/
 	s.limit = s.base() + size*n
 	heapBitsForAddr(s.base()).initSpan(s)
+	fireSpanEvent(SpanGrow, c.spanclass, npages, n, s.base())
 	return s
 }
@@ -7,6 +7,7 @@
 package runtime
 
 import (
+	"runtime/internal/atomic"
 	"unsafe"
 )
 
@@ -27,13 +28,49 @@ func sysAlloc(n uintptr, sysStat *uint64) unsafe.Pointer {
 	return v
 }
 
+// _MADV_DONTNEED 是 _MADV_FREE 的保底方案：没有 MADV_FREE 快，但这个文件覆盖的系统都支持它，
+// 而且它对 RSS 的影响是立即生效的。
+const _MADV_DONTNEED = 4
+
+// adviseUnused 是 sysUnused 传给 madvise 的提示，表示“这块内存可以回收了”。
+/**
+默认先用 _MADV_FREE，更便宜（系统可以先不收回，等真的缺内存再收，如果我们在那之前又碰了这块内存，
+直接复用就行）；但这个文件覆盖的某些系统上 MADV_FREE 要么没实现、要么用了以后 RSS 降不下来，
+等于白跑一趟 scavenger。第一次发现 madvise 报错，就永久切到 _MADV_DONTNEED，跟 mem_linux.go
+应付老内核没有 MADV_FREE 时的做法一样。
+
+Solaris/illumos 上直接从 _MADV_DONTNEED 起步，因为那边 MADV_FREE 按需回收的行为经常压不住 RSS。
+*/
+var adviseUnused = uint32(_MADV_FREE)
+
+func init() {
+	if GOOS == "solaris" || GOOS == "illumos" {
+		adviseUnused = _MADV_DONTNEED
+	}
+}
+
 // 通知操作系统虚拟内存对应的物理内存已经不再需要了，它可以重用物理内存；
 func sysUnused(v unsafe.Pointer, n uintptr) {
-	madvise(v, n, _MADV_FREE)
+	advise := atomic.Load(&adviseUnused)
+	if debug.madvdontneed != 0 && advise == _MADV_FREE {
+		advise = _MADV_DONTNEED
+	}
+	// madvise 在这个文件覆盖的系统上不是一个签名：dragonfly/freebsd/netbsd/openbsd
+	// 的包装返回 errno，Solaris 的（sysvicall3）不返回。判断“这次 advise 有没有被拒绝”
+	// 的逻辑因此按 GOOS 拆到了 madvise_bsd.go / madvise_solaris.go 里。
+	if madviseRejected(v, n, int32(advise)) && advise == _MADV_FREE {
+		// MADV_FREE isn't supported (or isn't trustworthy) here after
+		// all; fall back for this and all future calls.
+		atomic.Store(&adviseUnused, _MADV_DONTNEED)
+		madviseRejected(v, n, _MADV_DONTNEED)
+	}
 }
 
 // 通知操作系统应用程序需要使用该内存区域，需要保证内存区域可以安全访问；
 func sysUsed(v unsafe.Pointer, n uintptr) {
+	// Nothing to do: both _MADV_FREE and _MADV_DONTNEED leave the
+	// mapping in place, so the next access either finds the old page
+	// still there (not yet reclaimed) or faults in a new one on demand.
 }
 
 func sysHugePage(v unsafe.Pointer, n uintptr) {
@@ -0,0 +1,165 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/**
+给外部工具一个 hook，在 mcentral 的 cacheSpan/uncacheSpan/freeSpan/grow 这几个
+span 跨越 mcentral 和 mcache/mheap 边界的时刻都会触发一次。为了不影响分配路径的延迟，
+触发的地方只做一次原子判断和一次入队，真正调用用户传进来的函数是在专门的后台 goroutine 里做的。
+*/
+
+package runtime
+
+import "runtime/internal/atomic"
+
+// SpanEventKind identifies which mcentral operation produced a SpanEvent.
+type SpanEventKind uint8
+
+const (
+	SpanCache SpanEventKind = iota
+	SpanUncache
+	SpanFree
+	SpanGrow
+)
+
+// SpanEvent describes one mspan crossing the mcentral/mcache or
+// mcentral/mheap boundary: handed to an mcache (SpanCache), returned from
+// one (SpanUncache), released by mcentral.freeSpan once it holds no
+// allocated objects, either back to the heap or into a shard's hand-off
+// slot (SpanFree), or grown fresh from the heap (SpanGrow). A hand-off
+// span that reclaimIdleHandoff later returns to the heap produces no
+// further event.
+type SpanEvent struct {
+	Kind      SpanEventKind
+	SizeClass uint8
+	NPages    uintptr
+	NFree     uintptr // free objects in the span at the time of the event
+	Addr      uintptr // span base address
+}
+
+// spanEventEnabled is checked on every cacheSpan/uncacheSpan/freeSpan/grow
+// call, so it's a single atomic load when no hook is installed, which is
+// the overwhelmingly common case.
+var spanEventEnabled uint32
+
+var (
+	spanEventHookMu     mutex
+	spanEventHookFn     func(SpanEvent)
+	spanEventDrainerRan uint32
+)
+
+// SetSpanEventHook registers fn to be called, from a dedicated background
+// goroutine, for every span that mcentral hands to or takes back from an
+// mcache, releases in freeSpan (to the heap or to a hand-off slot), or
+// grows fresh from the heap. Passing nil disables
+// the hook.
+//
+// fn is never called on the allocator's hot path or while any mcentral
+// lock is held: events are queued to a small set of ring buffers and
+// delivered later, so a slow or blocking fn can't introduce allocator
+// latency or deadlock against an allocation in progress. A sufficiently
+// slow fn can still fall behind, in which case newer events are dropped
+// rather than buffered without bound.
+func SetSpanEventHook(fn func(SpanEvent)) {
+	lock(&spanEventHookMu)
+	spanEventHookFn = fn
+	if fn != nil {
+		atomic.Store(&spanEventEnabled, 1)
+		if atomic.Cas(&spanEventDrainerRan, 0, 1) {
+			go spanEventDrain()
+		}
+	} else {
+		atomic.Store(&spanEventEnabled, 0)
+	}
+	unlock(&spanEventHookMu)
+}
+
+// _NumSpanEventRings mirrors _NumMCentralShards: spreading events across
+// a handful of rings, hashed by the producing P, keeps producers from
+// serializing on a single ring lock the way they used to on mcentral's
+// single c.lock.
+const _NumSpanEventRings = _NumMCentralShards
+
+const spanEventRingSize = 256 // power of two
+
+// spanEventRing is a small fixed-capacity queue of pending SpanEvents.
+// It's not the lock-free SPSC ring a hot path would ideally want, but it
+// is cheap (no allocation, no syscalls) and, critically, is the only
+// thing producers touch: it never calls into user code itself.
+type spanEventRing struct {
+	lock mutex
+	buf  [spanEventRingSize]SpanEvent
+	head uint32
+	tail uint32
+}
+
+func (r *spanEventRing) push(ev SpanEvent) {
+	lock(&r.lock)
+	next := (r.tail + 1) % spanEventRingSize
+	if next != r.head {
+		r.buf[r.tail] = ev
+		r.tail = next
+	}
+	// else: ring is full; drop the event rather than block an allocation.
+	unlock(&r.lock)
+}
+
+func (r *spanEventRing) drain(fn func(SpanEvent)) {
+	for {
+		lock(&r.lock)
+		if r.head == r.tail {
+			unlock(&r.lock)
+			return
+		}
+		ev := r.buf[r.head]
+		r.head = (r.head + 1) % spanEventRingSize
+		unlock(&r.lock)
+		fn(ev)
+	}
+}
+
+var spanEventRings [_NumSpanEventRings]spanEventRing
+
+// spanEventRingIndex hashes the calling P onto a ring, the same way
+// mcentral.shardIndex hashes it onto a shard.
+func spanEventRingIndex() int {
+	pid := int32(0)
+	if gp := getg(); gp.m.p != 0 {
+		pid = gp.m.p.ptr().id
+	}
+	return int(uint32(pid) % _NumSpanEventRings)
+}
+
+// fireSpanEvent is the hot-path entry point: nil-checked with a single
+// atomic load, and does nothing more than a locked ring push when a hook
+// is installed.
+func fireSpanEvent(kind SpanEventKind, spc spanClass, npages, nfree, addr uintptr) {
+	if atomic.Load(&spanEventEnabled) == 0 {
+		return
+	}
+	ev := SpanEvent{
+		Kind:      kind,
+		SizeClass: uint8(spc.sizeclass()),
+		NPages:    npages,
+		NFree:     nfree,
+		Addr:      addr,
+	}
+	spanEventRings[spanEventRingIndex()].push(ev)
+}
+
+// spanEventDrain runs forever on its own goroutine, delivering queued
+// SpanEvents to the installed hook. It's started lazily, once, the first
+// time SetSpanEventHook is given a non-nil fn.
+func spanEventDrain() {
+	for {
+		lock(&spanEventHookMu)
+		fn := spanEventHookFn
+		unlock(&spanEventHookMu)
+		if fn != nil {
+			for i := range spanEventRings {
+				spanEventRings[i].drain(fn)
+			}
+		}
+		usleep(1000) // 1ms poll; events are diagnostic, not latency-sensitive
+	}
+}